@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/integration-system/isp-log"
+	"github.com/pkg/errors"
+)
+
+// Checkpoint is the on-disk representation of a run's progress, written
+// periodically to --checkpoint so an interrupted run can resume instead
+// of restarting from row 0.
+type Checkpoint struct {
+	ConfigHash string         `json:"configHash"`
+	TotalRows  int64          `json:"totalRows"`
+	SavedAt    time.Time      `json:"savedAt"`
+	Csv        *CsvCheckpoint `json:"csv,omitempty"`
+	Db         *DbCheckpoint  `json:"db,omitempty"`
+}
+
+// CsvCheckpoint records a CsvDataSource's resume position. Rows is the
+// count of data rows already processed; encoding/csv buffers its input
+// internally, so the underlying file's byte offset doesn't line up with
+// a row boundary and can't be seeked to directly (gzipped or not) -
+// resuming instead re-reads and discards the first Rows rows, which is
+// O(Rows) but always correct.
+type CsvCheckpoint struct {
+	Rows int64 `json:"rows"`
+}
+
+// DbCheckpoint records a DbDataSource's resume position: the last value
+// seen in the configured DbSource.KeyColumn, and Rows, the cumulative
+// count of rows processed across this and all prior resumes (mirroring
+// CsvCheckpoint.Rows), so TotalRows stays a true cumulative count instead
+// of resetting to the current run's count alone.
+type DbCheckpoint struct {
+	LastKey string `json:"lastKey"`
+	Rows    int64  `json:"rows"`
+}
+
+// sourceConfigHash hashes the whole Source config, which includes
+// everything that determines which rows will be read, so a checkpoint can
+// be rejected if the source config changed between runs. Options that do
+// not affect which rows are read, such as DbSource.CountTotal, are hashed
+// too, so changing them also rejects the checkpoint.
+func sourceConfigHash(src Source) (string, error) {
+	b, err := json.Marshal(src)
+	if err != nil {
+		return "", errors.WithMessage(err, "marshal source config")
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// LoadCheckpoint reads a checkpoint file, returning nil if it doesn't
+// exist yet.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "read checkpoint file")
+	}
+
+	cp := &Checkpoint{}
+	if err := json.Unmarshal(b, cp); err != nil {
+		return nil, errors.WithMessage(err, "parse checkpoint file")
+	}
+	return cp, nil
+}
+
+// save writes the checkpoint atomically (write to a temp file, then
+// rename) so a crash mid-write never leaves a corrupt checkpoint behind.
+func (c *Checkpoint) save(path string) error {
+	c.SavedAt = time.Now()
+
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return errors.WithMessage(err, "marshal checkpoint")
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return errors.WithMessage(err, "write checkpoint file")
+	}
+	return os.Rename(tmp, path)
+}
+
+// checkpointable is implemented by DataSources that can report a resume
+// position as of a given number of rows committed (see Pipeline.Committed).
+type checkpointable interface {
+	checkpointState(through int64) (*CsvCheckpoint, *DbCheckpoint)
+}
+
+// committer reports how many rows a Pipeline has durably disposed of, and
+// is the only progress counter safe to checkpoint - see Pipeline.Committed.
+type committer interface {
+	Committed() int64
+}
+
+// runCheckpointer periodically saves pipeline's committed progress to
+// path until done is closed, then does one final save so the very last
+// position is never lost. It returns once the final save is done, so
+// callers should wait for it before closing the source.
+//
+// done, not ctx cancellation, is what ends the loop: ctx is typically
+// cancelled well before the pipeline has finished draining in-flight rows
+// (e.g. the instant a SIGINT arrives), and saving at that instant would
+// persist a Committed() that undercounts rows the pipeline goes on to
+// finish during drain, making the next resume reprocess them. Callers
+// must only close done after the pipeline has fully drained.
+//
+// It checkpoints off pipeline.Committed rather than source.Progress: the
+// latter advances the instant a row is read, before it has reached
+// convert or publish, so a crash between the two could make a resume skip
+// rows that were never actually handled.
+func runCheckpointer(path string, configHash string, source DataSource, pipeline committer, cfg CheckpointConfig, done <-chan struct{}) {
+	cs, ok := source.(checkpointable)
+	if !ok || path == "" {
+		return
+	}
+
+	save := func() {
+		through := pipeline.Committed()
+		csvState, dbState := cs.checkpointState(through)
+
+		totalRows := through
+		switch {
+		case csvState != nil:
+			totalRows = csvState.Rows
+		case dbState != nil:
+			totalRows = dbState.Rows
+		}
+
+		cp := &Checkpoint{
+			ConfigHash: configHash,
+			TotalRows:  totalRows,
+			Csv:        csvState,
+			Db:         dbState,
+		}
+		if err := cp.save(path); err != nil {
+			log.Errorf(0, "saving checkpoint: %v", err)
+		}
+	}
+
+	// pollInterval must be shorter than cfg.EveryInterval, or a run whose
+	// row count never reaches cfg.EveryRows within one cfg.EveryInterval
+	// would only ever discover that the interval elapsed once the next
+	// (too-late) tick fires.
+	pollInterval := cfg.EveryInterval / 10
+	if pollInterval <= 0 || pollInterval > time.Second {
+		pollInterval = time.Second
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	var (
+		lastSavedRows int64
+		lastSavedAt   = time.Now()
+	)
+	for {
+		select {
+		case <-ticker.C:
+			through := pipeline.Committed()
+			if through-lastSavedRows >= cfg.EveryRows || time.Since(lastSavedAt) >= cfg.EveryInterval {
+				save()
+				lastSavedRows = through
+				lastSavedAt = time.Now()
+			}
+		case <-done:
+			save()
+			return
+		}
+	}
+}
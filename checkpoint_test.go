@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestCsvCheckpointStateAddsBaseline(t *testing.T) {
+	s := &CsvDataSource{baseline: 100}
+
+	csvState, dbState := s.checkpointState(7)
+	if dbState != nil {
+		t.Fatalf("dbState = %+v, want nil", dbState)
+	}
+	if csvState.Rows != 107 {
+		t.Fatalf("Rows = %d, want 107", csvState.Rows)
+	}
+}
+
+func TestDbCheckpointStateResolvesLastKeyAndTrims(t *testing.T) {
+	s := &DbDataSource{
+		baseline: 50,
+		keys:     []string{"k0", "k1", "k2", "k3"},
+	}
+
+	csvState, dbState := s.checkpointState(3)
+	if csvState != nil {
+		t.Fatalf("csvState = %+v, want nil", csvState)
+	}
+	if dbState.LastKey != "k2" {
+		t.Fatalf("LastKey = %q, want %q", dbState.LastKey, "k2")
+	}
+	if dbState.Rows != 53 {
+		t.Fatalf("Rows = %d, want 53", dbState.Rows)
+	}
+
+	// Entries up to and including position 2 (index 2) must be trimmed,
+	// so a later call resolves positions relative to the new keysBase.
+	if got, want := s.keysBase, int64(3); got != want {
+		t.Fatalf("keysBase = %d, want %d", got, want)
+	}
+	if got, want := len(s.keys), 1; got != want {
+		t.Fatalf("len(keys) = %d, want %d", got, want)
+	}
+
+	_, dbState = s.checkpointState(4)
+	if dbState.LastKey != "k3" {
+		t.Fatalf("LastKey = %q, want %q", dbState.LastKey, "k3")
+	}
+}
+
+func TestDbCheckpointStateNoKeysYet(t *testing.T) {
+	s := &DbDataSource{}
+
+	_, dbState := s.checkpointState(0)
+	if dbState.LastKey != "" {
+		t.Fatalf("LastKey = %q, want empty", dbState.LastKey)
+	}
+	if dbState.Rows != 0 {
+		t.Fatalf("Rows = %d, want 0", dbState.Rows)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"time"
+
+	"github.com/integration-system/isp-event-lib/mq"
+	"github.com/integration-system/isp-lib/v2/structure"
+)
+
+type Config struct {
+	Source     Source           `valid:"required"`
+	Target     Target           `valid:"required"`
+	Script     Script           ``
+	Pipeline   PipelineConfig   ``
+	Checkpoint CheckpointConfig ``
+	Metrics    MetricsConfig    ``
+	Retry      RetryConfig      ``
+	DeadLetter DeadLetterConfig ``
+}
+
+type Source struct {
+	Csv *CsvSource
+	DB  *DbSource
+}
+
+type CsvSource struct {
+	Filename  string `valid:"required"`
+	Delimiter string
+	GZip      bool
+}
+
+type DbSource struct {
+	Address string `valid:"required"`
+	Query   string `valid:"required"`
+	// KeyColumn, if set, enables resuming a DB source from a checkpoint:
+	// rows are read with an additional `WHERE KeyColumn > :last_value`
+	// filter, so KeyColumn must be part of Query's result columns and be
+	// monotonically ordered (e.g. a primary key).
+	KeyColumn string
+	// CountTotal runs an extra `SELECT count(*)` up front so Progress and
+	// the --progress bar know the total row count. It is opt-in because
+	// it can be expensive on a large or unindexed query.
+	CountTotal bool
+}
+
+type Target struct {
+	Rabbit    structure.RabbitConfig
+	Publisher mq.PublisherCfg
+	// DeadLetterPublisher is derived at startup from DeadLetterConfig.Rabbit
+	// when set; it is not read from the config file directly.
+	DeadLetterPublisher *mq.PublisherCfg `yaml:"-"`
+}
+
+type Script struct {
+	Filename string
+}
+
+// PipelineConfig configures the concurrent reader/converter/publisher stages.
+// Zero values fall back to sane defaults in NewPipeline.
+type PipelineConfig struct {
+	ConverterWorkers int
+	PublisherWorkers int
+	QueueSize        int
+	// PublisherConfirms would enable RabbitMQ publisher confirms so the
+	// publish stage blocks on the broker's ack instead of just the TCP
+	// write, giving real backpressure instead of QueueSize's fixed bound.
+	// Not implemented: github.com/integration-system/isp-event-lib/mq
+	// constructs its cony.Publisher internally with no way to pass
+	// cony.WithConfirmation, so there is currently no path to confirms
+	// without forking that dependency. Rejected at startup rather than
+	// silently ignored.
+	PublisherConfirms bool
+}
+
+const (
+	defaultConverterWorkers = 4
+	defaultPublisherWorkers = 4
+	defaultQueueSize        = 256
+)
+
+func (p PipelineConfig) withDefaults() PipelineConfig {
+	if p.ConverterWorkers <= 0 {
+		p.ConverterWorkers = defaultConverterWorkers
+	}
+	if p.PublisherWorkers <= 0 {
+		p.PublisherWorkers = defaultPublisherWorkers
+	}
+	if p.QueueSize <= 0 {
+		p.QueueSize = defaultQueueSize
+	}
+	return p
+}
+
+// CheckpointConfig controls how often progress is persisted to the
+// --checkpoint file, so a killed run can resume instead of restarting
+// from row 0.
+type CheckpointConfig struct {
+	EveryRows     int64
+	EveryInterval time.Duration
+}
+
+const (
+	defaultCheckpointEveryRows     = 1000
+	defaultCheckpointEveryInterval = 10 * time.Second
+)
+
+func (c CheckpointConfig) withDefaults() CheckpointConfig {
+	if c.EveryRows <= 0 {
+		c.EveryRows = defaultCheckpointEveryRows
+	}
+	if c.EveryInterval <= 0 {
+		c.EveryInterval = defaultCheckpointEveryInterval
+	}
+	return c
+}
+
+// MetricsConfig configures the optional embedded Prometheus endpoint. It
+// is left disabled (Addr == "") by default.
+type MetricsConfig struct {
+	Addr string
+}
+
+// RetryConfig controls how publish failures are retried before a row is
+// sent to the dead-letter sink.
+type RetryConfig struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+}
+
+const (
+	defaultMaxAttempts    = 5
+	defaultInitialBackoff = 200 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+	defaultMultiplier     = 2.0
+	defaultJitter         = 0.2
+)
+
+func (r RetryConfig) withDefaults() RetryConfig {
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = defaultMaxAttempts
+	}
+	if r.InitialBackoff <= 0 {
+		r.InitialBackoff = defaultInitialBackoff
+	}
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = defaultMaxBackoff
+	}
+	if r.Multiplier <= 0 {
+		r.Multiplier = defaultMultiplier
+	}
+	if r.Jitter <= 0 {
+		r.Jitter = defaultJitter
+	}
+	return r
+}
+
+// DeadLetterConfig selects where rows go once Retry is exhausted or the
+// publish error is non-recoverable. At most one of File/Rabbit should be
+// set; if neither is set, the publish error is returned as a fatal
+// pipeline error and the run ends with an error.
+type DeadLetterConfig struct {
+	File   *DeadLetterFileConfig
+	Rabbit *DeadLetterRabbitConfig
+}
+
+type DeadLetterFileConfig struct {
+	Path string `valid:"required"`
+}
+
+type DeadLetterRabbitConfig struct {
+	ExchangeName string `valid:"required"`
+	RoutingKey   string
+}
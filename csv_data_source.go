@@ -0,0 +1,142 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// CsvDataSource reads rows from a (optionally gzipped) CSV file, using the
+// first line as the column header. Rows are returned in file order.
+//
+// GetRow must only be called from a single goroutine.
+type CsvDataSource struct {
+	file   *os.File
+	gzip   *gzip.Reader
+	reader *csv.Reader
+	header []string
+	size   int64
+	read   int64
+	// baseline is the cumulative row count carried over from a prior
+	// resume, frozen at construction; checkpointState adds it to the
+	// current run's committed count so CsvCheckpoint.Rows stays
+	// cumulative across resumes.
+	baseline int64
+}
+
+// NewCsvDataSource opens cfg.Filename and, if resume is non-nil, skips
+// past the rows it recorded as already processed.
+func NewCsvDataSource(cfg CsvSource, resume *CsvCheckpoint) (*CsvDataSource, error) {
+	f, err := os.Open(cfg.Filename)
+	if err != nil {
+		return nil, errors.WithMessage(err, "open csv file")
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.WithMessage(err, "stat csv file")
+	}
+
+	var (
+		gz     *gzip.Reader
+		reader io.Reader = f
+	)
+	if cfg.GZip {
+		gz, err = gzip.NewReader(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, errors.WithMessage(err, "open gzip reader")
+		}
+		reader = gz
+	}
+
+	cr := csv.NewReader(reader)
+	if cfg.Delimiter != "" {
+		cr.Comma = rune(cfg.Delimiter[0])
+	}
+
+	header, err := cr.Read()
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.WithMessage(err, "read csv header")
+	}
+
+	source := &CsvDataSource{
+		file:   f,
+		gzip:   gz,
+		reader: cr,
+		header: header,
+		size:   info.Size(),
+	}
+
+	if resume != nil {
+		for i := int64(0); i < resume.Rows; i++ {
+			if _, err := cr.Read(); err != nil {
+				return nil, errors.WithMessage(err, "skip already processed rows")
+			}
+		}
+		source.read = resume.Rows
+		source.baseline = resume.Rows
+	}
+
+	return source, nil
+}
+
+func (s *CsvDataSource) GetRow() (map[string]interface{}, error) {
+	record, err := s.reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "read csv record")
+	}
+
+	row := make(map[string]interface{}, len(s.header))
+	for i, column := range s.header {
+		if i < len(record) {
+			row[column] = record[i]
+		}
+	}
+	atomic.AddInt64(&s.read, 1)
+
+	return row, nil
+}
+
+// Progress returns the number of rows read so far and the approximate
+// percentage of the file consumed, based on the underlying file offset.
+func (s *CsvDataSource) Progress() (int64, float32) {
+	read := atomic.LoadInt64(&s.read)
+	if s.size == 0 {
+		return read, 0
+	}
+
+	offset, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return read, 0
+	}
+
+	return read, float32(offset) / float32(s.size) * 100
+}
+
+// Total returns the file size in bytes.
+func (s *CsvDataSource) Total() int64 {
+	return s.size
+}
+
+// checkpointState reports a resume position as of through rows committed
+// by the pipeline in this run; baseline carries forward any rows already
+// committed in prior runs, so Rows stays cumulative across resumes.
+func (s *CsvDataSource) checkpointState(through int64) (*CsvCheckpoint, *DbCheckpoint) {
+	return &CsvCheckpoint{Rows: s.baseline + through}, nil
+}
+
+func (s *CsvDataSource) Close() error {
+	if s.gzip != nil {
+		_ = s.gzip.Close()
+	}
+	return s.file.Close()
+}
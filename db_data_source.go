@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+)
+
+// DbDataSource streams rows from a SQL query against a Postgres database,
+// reading them one at a time from a single query result.
+//
+// GetRow must only be called from a single goroutine.
+type DbDataSource struct {
+	ctx            context.Context
+	conn           *pgx.Conn
+	rows           pgx.Rows
+	fieldNames     []string
+	keyColumnIndex int
+	read           int64
+	total          int64
+	// baseline is the cumulative row count carried over from a prior
+	// resume, frozen at construction; checkpointState adds it to the
+	// current run's committed count so DbCheckpoint.Rows stays
+	// cumulative across resumes.
+	baseline int64
+
+	// keysMu guards keys and keysBase, which checkpointState (called from
+	// the checkpointer goroutine) reads and trims concurrently with
+	// GetRow (called from the reader goroutine) appending to them.
+	keysMu sync.Mutex
+	// keys[i] is the KeyColumn value of the row read at this run's
+	// position keysBase+i; checkpointState trims entries once committed
+	// has passed them, since they can never be looked up again.
+	keys     []string
+	keysBase int64
+}
+
+// NewDbDataSource connects to cfg.Address and runs cfg.Query. If resume
+// is non-nil, rows up to and including resume.LastKey are skipped by
+// adding a `WHERE cfg.KeyColumn > resume.LastKey` filter, which requires
+// cfg.KeyColumn to be set and to appear in cfg.Query's result columns.
+func NewDbDataSource(cfg DbSource, resume *DbCheckpoint) (*DbDataSource, error) {
+	ctx := context.Background()
+
+	conn, err := pgx.Connect(ctx, cfg.Address)
+	if err != nil {
+		return nil, errors.WithMessage(err, "connect to db")
+	}
+
+	query := cfg.Query
+	var args []interface{}
+	if resume != nil && resume.LastKey != "" {
+		if cfg.KeyColumn == "" {
+			_ = conn.Close(ctx)
+			return nil, errors.New("resuming a db source requires source.db.keyColumn to be set")
+		}
+		// Values are compared as text: KeyColumn should be a type whose
+		// text ordering matches its natural ordering, e.g. a zero-padded
+		// or UUID primary key.
+		query = fmt.Sprintf("SELECT * FROM (%s) q WHERE q.%s::text > $1 ORDER BY q.%s", cfg.Query, cfg.KeyColumn, cfg.KeyColumn)
+		args = append(args, resume.LastKey)
+	}
+
+	var total int64
+	if cfg.CountTotal {
+		err = conn.QueryRow(ctx, "SELECT count(*) FROM ("+query+") c", args...).Scan(&total)
+		if err != nil {
+			_ = conn.Close(ctx)
+			return nil, errors.WithMessage(err, "count rows")
+		}
+	}
+
+	rows, err := conn.Query(ctx, query, args...)
+	if err != nil {
+		_ = conn.Close(ctx)
+		return nil, errors.WithMessage(err, "execute query")
+	}
+
+	fieldNames := make([]string, 0, len(rows.FieldDescriptions()))
+	keyColumnIndex := -1
+	for i, fd := range rows.FieldDescriptions() {
+		name := string(fd.Name)
+		fieldNames = append(fieldNames, name)
+		if name == cfg.KeyColumn {
+			keyColumnIndex = i
+		}
+	}
+
+	source := &DbDataSource{
+		ctx:            ctx,
+		conn:           conn,
+		rows:           rows,
+		fieldNames:     fieldNames,
+		keyColumnIndex: keyColumnIndex,
+		total:          total,
+	}
+	if resume != nil {
+		source.read = resume.Rows
+		source.baseline = resume.Rows
+	}
+
+	return source, nil
+}
+
+func (s *DbDataSource) GetRow() (map[string]interface{}, error) {
+	if !s.rows.Next() {
+		if err := s.rows.Err(); err != nil {
+			return nil, errors.WithMessage(err, "read db row")
+		}
+		return nil, nil
+	}
+
+	values, err := s.rows.Values()
+	if err != nil {
+		return nil, errors.WithMessage(err, "decode db row")
+	}
+
+	row := make(map[string]interface{}, len(s.fieldNames))
+	for i, name := range s.fieldNames {
+		row[name] = values[i]
+	}
+	if s.keyColumnIndex >= 0 {
+		key := fmt.Sprint(values[s.keyColumnIndex])
+
+		s.keysMu.Lock()
+		s.keys = append(s.keys, key)
+		s.keysMu.Unlock()
+	}
+	atomic.AddInt64(&s.read, 1)
+
+	return row, nil
+}
+
+func (s *DbDataSource) Progress() (int64, float32) {
+	read := atomic.LoadInt64(&s.read)
+	if s.total == 0 {
+		return read, 0
+	}
+	return read, float32(read) / float32(s.total) * 100
+}
+
+// Total returns the row count known from CountTotal, or 0 if it was not
+// requested.
+func (s *DbDataSource) Total() int64 {
+	return s.total
+}
+
+// checkpointState reports a resume position as of through rows committed
+// by the pipeline in this run: the KeyColumn value of the row at that
+// position, so a later resume's `WHERE KeyColumn > lastKey` filter skips
+// exactly (and only) what was actually committed. baseline carries
+// forward any rows already committed in prior runs, so Rows stays
+// cumulative across resumes.
+//
+// Entries for positions at or before through are trimmed afterwards,
+// since committed only ever moves forward and they'll never be looked up
+// again.
+func (s *DbDataSource) checkpointState(through int64) (*CsvCheckpoint, *DbCheckpoint) {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+
+	var lastKey string
+	if idx := through - 1 - s.keysBase; idx >= 0 && idx < int64(len(s.keys)) {
+		lastKey = s.keys[idx]
+	}
+
+	if trim := through - s.keysBase; trim > 0 {
+		if trim > int64(len(s.keys)) {
+			trim = int64(len(s.keys))
+		}
+		s.keys = s.keys[trim:]
+		s.keysBase += trim
+	}
+
+	return nil, &DbCheckpoint{LastKey: lastKey, Rows: s.baseline + through}
+}
+
+func (s *DbDataSource) Close() error {
+	s.rows.Close()
+	return s.conn.Close(s.ctx)
+}
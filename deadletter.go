@@ -0,0 +1,113 @@
+package main
+
+import (
+	"compress/gzip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/pkg/errors"
+)
+
+// DeadLetterSink receives rows whose publish failed permanently: retries
+// were exhausted, or the AMQP error was non-recoverable.
+type DeadLetterSink interface {
+	Write(row map[string]interface{}, cause error, attempt int) error
+	Close() error
+}
+
+// deadLetterRecord is the shape written by FileDeadLetterSink, one per
+// NDJSON line.
+type deadLetterRecord struct {
+	Row       map[string]interface{} `json:"row"`
+	Error     string                 `json:"error"`
+	Attempt   int                    `json:"attempt"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// FileDeadLetterSink appends one gzip-compressed NDJSON line per failed
+// row to a file, creating it if necessary.
+type FileDeadLetterSink struct {
+	mu   sync.Mutex
+	file *os.File
+	gz   *gzip.Writer
+}
+
+func NewFileDeadLetterSink(cfg DeadLetterFileConfig) (*FileDeadLetterSink, error) {
+	f, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.WithMessage(err, "open dead-letter file")
+	}
+
+	return &FileDeadLetterSink{file: f, gz: gzip.NewWriter(f)}, nil
+}
+
+func (s *FileDeadLetterSink) Write(row map[string]interface{}, cause error, attempt int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := json.Marshal(deadLetterRecord{
+		Row:       row,
+		Error:     cause.Error(),
+		Attempt:   attempt,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return errors.WithMessage(err, "marshal dead-letter record")
+	}
+	b = append(b, '\n')
+
+	if _, err := s.gz.Write(b); err != nil {
+		return errors.WithMessage(err, "write dead-letter record")
+	}
+	return s.gz.Flush()
+}
+
+func (s *FileDeadLetterSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.gz.Close(); err != nil {
+		_ = s.file.Close()
+		return errors.WithMessage(err, "close dead-letter gzip writer")
+	}
+	return s.file.Close()
+}
+
+// RabbitDeadLetterSink republishes failed rows, wrapped with their cause
+// and attempt count, through publish - typically a closure over a second
+// publisher registered with the dead-letter exchange/routing key, so it
+// shares the main publish path's broker connection.
+type RabbitDeadLetterSink struct {
+	publish func(amqp.Publishing) error
+}
+
+func NewRabbitDeadLetterSink(publish func(amqp.Publishing) error) *RabbitDeadLetterSink {
+	return &RabbitDeadLetterSink{publish: publish}
+}
+
+func (s *RabbitDeadLetterSink) Write(row map[string]interface{}, cause error, attempt int) error {
+	body, err := json.Marshal(deadLetterRecord{
+		Row:       row,
+		Error:     cause.Error(),
+		Attempt:   attempt,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return errors.WithMessage(err, "marshal dead-letter record")
+	}
+
+	return s.publish(amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         body,
+		DeliveryMode: amqp.Persistent,
+	})
+}
+
+// Close is a no-op: the underlying connection is owned and closed by the
+// main publisher's mqClient.
+func (s *RabbitDeadLetterSink) Close() error {
+	return nil
+}
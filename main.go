@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/asaskevich/govalidator"
@@ -17,7 +23,17 @@ import (
 )
 
 const (
-	publisherName = "publisher_name"
+	publisherName           = "publisher_name"
+	deadLetterPublisherName = "deadletter_publisher_name"
+)
+
+// Exit codes. exitInterrupted lets operators tell a clean shutdown apart
+// from a SIGINT/SIGTERM abort when deciding whether to rerun with
+// --checkpoint.
+const (
+	exitOK          = 0
+	exitError       = 1
+	exitInterrupted = 130
 )
 
 type DataSource interface {
@@ -27,17 +43,25 @@ type DataSource interface {
 }
 
 var (
-	csvFilepath    = ""
-	configFilepath = ""
-	scriptFilepath = ""
+	csvFilepath        = ""
+	configFilepath     = ""
+	scriptFilepath     = ""
+	checkpointFilepath = ""
+	progressEnabled    = false
 )
 
 var json = jsoniter.ConfigFastest
 
 func main() {
+	os.Exit(run())
+}
+
+func run() int {
 	flag.StringVar(&configFilepath, "config", "config.yaml", "config file path")
 	flag.StringVar(&csvFilepath, "csv_file", "", ".csv.gz source file path")
 	flag.StringVar(&scriptFilepath, "script", "", "script file path")
+	flag.StringVar(&checkpointFilepath, "checkpoint", "", "checkpoint file path, enables resuming an interrupted run")
+	flag.BoolVar(&progressEnabled, "progress", false, "show an interactive progress bar (requires a terminal)")
 	flag.CommandLine.SetOutput(os.Stdout)
 	flag.Parse()
 
@@ -46,12 +70,12 @@ func main() {
 	b, err := ioutil.ReadFile(configFilepath)
 	if err != nil {
 		log.Errorf(0, "reading config: %v", err)
-		return
+		return exitError
 	}
 	err = yaml.Unmarshal(b, &cfg)
 	if err != nil {
 		log.Errorf(0, "parsing config: %v", err)
-		return
+		return exitError
 	}
 
 	if csvFilepath != "" {
@@ -64,7 +88,42 @@ func main() {
 	_, err = govalidator.ValidateStruct(cfg)
 	if err != nil {
 		log.Errorf(0, "invalid config: %v", govalidator.ErrorsByField(err))
-		return
+		return exitError
+	}
+	if cfg.Pipeline.PublisherConfirms {
+		log.Error(0, "pipeline.publisherConfirms: not implemented, see PipelineConfig.PublisherConfirms doc comment")
+		return exitError
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shutdownMetrics := serveMetrics(cfg.Metrics)
+	defer func() {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		if err := shutdownMetrics(shutdownCtx); err != nil {
+			log.Errorf(0, "stopping metrics server: %v", err)
+		}
+	}()
+
+	var interrupted int32
+
+	// Dead-letter sink: rows that exhaust Retry or hit a non-recoverable
+	// AMQP error go here instead of failing the whole run.
+	var deadLetter DeadLetterSink
+	switch {
+	case cfg.DeadLetter.File != nil:
+		deadLetter, err = NewFileDeadLetterSink(*cfg.DeadLetter.File)
+		if err != nil {
+			log.Errorf(0, "creating dead-letter file sink: %v", err)
+			return exitError
+		}
+	case cfg.DeadLetter.Rabbit != nil:
+		deadLetterPublisherCfg := cfg.Target.Publisher
+		deadLetterPublisherCfg.ExchangeName = cfg.DeadLetter.Rabbit.ExchangeName
+		deadLetterPublisherCfg.RoutingKey = cfg.DeadLetter.Rabbit.RoutingKey
+		cfg.Target.DeadLetterPublisher = &deadLetterPublisherCfg
 	}
 
 	// Publisher
@@ -72,49 +131,137 @@ func main() {
 	publishers := map[string]mq.PublisherCfg{
 		publisherName: cfg.Target.Publisher,
 	}
+	if cfg.Target.DeadLetterPublisher != nil {
+		publishers[deadLetterPublisherName] = *cfg.Target.DeadLetterPublisher
+	}
 	mqClient.ReceiveConfiguration(cfg.Target.Rabbit,
 		mq.WithPublishers(publishers),
 	)
 	defer mqClient.Close()
 	time.Sleep(100 * time.Millisecond) // REMOVE: wait for publisher initialization
 
-	publish := func(v interface{}) error {
+	if cfg.Target.DeadLetterPublisher != nil {
+		deadLetter = NewRabbitDeadLetterSink(func(msg amqp.Publishing) error {
+			return mqClient.GetPublisher(deadLetterPublisherName).Publish(msg)
+		})
+	}
+	if deadLetter != nil {
+		defer func() {
+			if err := deadLetter.Close(); err != nil {
+				log.Errorf(0, "closing dead-letter sink: %v", err)
+			}
+		}()
+	}
+
+	retryCfg := cfg.Retry.withDefaults()
+
+	publish := func(v map[string]interface{}) error {
+		start := time.Now()
 		body, err := json.Marshal(v)
 		if err != nil {
+			publishDuration.Observe(time.Since(start).Seconds())
+			rowsFailedTotal.WithLabelValues("publish").Inc()
 			return err
 		}
-
-		return mqClient.GetPublisher(publisherName).Publish(amqp.Publishing{
+		msg := amqp.Publishing{
 			ContentType:  "application/json",
 			Body:         body,
 			DeliveryMode: amqp.Persistent,
-		})
+		}
+
+		attempt := 1
+		for ; attempt <= retryCfg.MaxAttempts; attempt++ {
+			err = mqClient.GetPublisher(publisherName).Publish(msg)
+			if err == nil || attempt == retryCfg.MaxAttempts || !isRecoverablePublishErr(err) {
+				break
+			}
+
+			publishRetriesTotal.Inc()
+			select {
+			case <-time.After(backoff(retryCfg, attempt)):
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		publishDuration.Observe(time.Since(start).Seconds())
+
+		if err == nil {
+			rowsPublishedTotal.Inc()
+			return nil
+		}
+
+		rowsFailedTotal.WithLabelValues("publish").Inc()
+		if deadLetter == nil {
+			return err
+		}
+		if dlErr := deadLetter.Write(v, err, attempt); dlErr != nil {
+			return fmt.Errorf("dead-letter write after publish failure: %w", dlErr)
+		}
+		deadletterTotal.Inc()
+		return nil
 	}
 
 	// Script
-	var convert func(map[string]interface{}) (map[string]interface{}, error)
+	var convert func() func(map[string]interface{}) (map[string]interface{}, error)
 
 	if cfg.Script.Filename != "" {
 		b, err := ioutil.ReadFile(cfg.Script.Filename)
 		if err != nil {
 			log.Errorf(0, "reading script: %v", err)
-			return
+			return exitError
 		}
 		scr, err := script.Create(b)
 		if err != nil {
 			log.Errorf(0, "parsing script: %v", err)
-			return
+			return exitError
 		}
-		convert = func(m map[string]interface{}) (map[string]interface{}, error) {
-			val, err := script.Default().Execute(scr, m)
-			if err != nil {
-				return nil, err
+		// A *script.Executor is not safe for concurrent use, so each
+		// converter worker gets its own via script.New() instead of
+		// sharing script.Default().
+		convert = func() func(map[string]interface{}) (map[string]interface{}, error) {
+			executor := script.New()
+			return func(m map[string]interface{}) (map[string]interface{}, error) {
+				start := time.Now()
+				val, err := executor.Execute(scr, m)
+				scriptDuration.Observe(time.Since(start).Seconds())
+				if err != nil {
+					rowsFailedTotal.WithLabelValues("convert").Inc()
+					return nil, err
+				}
+				res, ok := val.(map[string]interface{})
+				if !ok {
+					rowsFailedTotal.WithLabelValues("convert").Inc()
+					return nil, errors.New("invalid conversion from script value to map")
+				}
+				return res, nil
 			}
-			res, ok := val.(map[string]interface{})
-			if !ok {
-				return nil, errors.New("invalid conversion from script value to map")
-			}
-			return res, nil
+		}
+	}
+
+	// Checkpoint
+	var configHash string
+	var csvResume *CsvCheckpoint
+	var dbResume *DbCheckpoint
+	if checkpointFilepath != "" {
+		configHash, err = sourceConfigHash(cfg.Source)
+		if err != nil {
+			log.Errorf(0, "hashing source config: %v", err)
+			return exitError
+		}
+
+		cp, err := LoadCheckpoint(checkpointFilepath)
+		if err != nil {
+			log.Errorf(0, "loading checkpoint: %v", err)
+			return exitError
+		}
+		if cp != nil && cp.ConfigHash != configHash {
+			log.Infof(0, "checkpoint at %s does not match the current source config, starting from the beginning", checkpointFilepath)
+		} else if cp != nil {
+			csvResume, dbResume = cp.Csv, cp.Db
+			log.Infof(0, "resuming from checkpoint: %d rows already processed", cp.TotalRows)
 		}
 	}
 
@@ -132,20 +279,20 @@ func main() {
 
 	switch {
 	case cfg.Source.Csv != nil:
-		source, err = NewCsvDataSource(*cfg.Source.Csv)
+		source, err = NewCsvDataSource(*cfg.Source.Csv, csvResume)
 		if err != nil {
 			log.Errorf(0, "creating csv source: %v", err)
-			return
+			return exitError
 		}
 	case cfg.Source.DB != nil:
-		source, err = NewDbDataSource(*cfg.Source.DB)
+		source, err = NewDbDataSource(*cfg.Source.DB, dbResume)
 		if err != nil {
 			log.Errorf(0, "creating db source: %v", err)
-			return
+			return exitError
 		}
 	default:
 		log.Error(0, "no source specified")
-		return
+		return exitError
 	}
 
 	started := time.Now()
@@ -154,40 +301,77 @@ func main() {
 		log.Infof(0, "total processed rows %d, elapsed time: %s", totalCount, time.Since(started).String())
 	}()
 
+	bar := NewProgressBar(progressEnabled, source)
+	go bar.Watch(ctx, source)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		atomic.StoreInt32(&interrupted, 1)
+		bar.Finish()
+		fmt.Println("Aborting...")
+		log.Info(0, "shutdown signal received, draining in-flight rows...")
+		cancel()
+	}()
+
 	go func() {
 		const printProgressInterval = 30 * time.Second
 		var count int64
 		for range time.NewTicker(printProgressInterval).C {
 			newTotal, percent := source.Progress()
 			diff := newTotal - count
-			log.Infof(0, "processed %d rows in %s; approximately %0.2f%% done", diff, printProgressInterval, percent)
+			if bar == nil {
+				log.Infof(0, "processed %d rows in %s; approximately %0.2f%% done", diff, printProgressInterval, percent)
+			}
 			count = newTotal
+			rowsReadTotal.Add(float64(diff))
+			sourceProgressRatio.Set(float64(percent) / 100)
 		}
 	}()
 
-	for {
-		row, err := source.GetRow()
-		if err != nil {
-			log.Errorf(0, "error reading row: %v", err)
+	// discardRow is called for a row the pipeline can't deliver to the
+	// next stage - typically because a shutdown is draining in-flight
+	// rows - so it's recorded via the dead-letter sink instead of
+	// disappearing without a trace.
+	discardRow := func(row map[string]interface{}, stage string) {
+		log.Warnf(0, "discarding row from %s stage on shutdown", stage)
+		if deadLetter == nil {
 			return
-		} else if row == nil {
-			break
 		}
-
-		if convert != nil {
-			row, err = convert(row)
-			if err != nil {
-				log.Errorf(0, "error executing script: %v", err)
-				return
-			}
-		}
-
-		err = publish(row)
-		if err != nil {
-			log.Errorf(0, "error publishing row: %v", err)
+		if dlErr := deadLetter.Write(row, fmt.Errorf("discarded from %s stage on shutdown", stage), 0); dlErr != nil {
+			log.Errorf(0, "dead-letter write for discarded row: %v", dlErr)
 			return
 		}
+		deadletterTotal.Inc()
+	}
+
+	pipeline := NewPipeline(source, convert, publish, discardRow, cfg.Pipeline)
+
+	var checkpointWG sync.WaitGroup
+	checkpointStop := make(chan struct{})
+	if checkpointFilepath != "" {
+		checkpointWG.Add(1)
+		go func() {
+			defer checkpointWG.Done()
+			runCheckpointer(checkpointFilepath, configHash, source, pipeline, cfg.Checkpoint.withDefaults(), checkpointStop)
+		}()
+	}
+
+	err = pipeline.Run(ctx)
+
+	close(checkpointStop)
+	checkpointWG.Wait()
+
+	if atomic.LoadInt32(&interrupted) == 1 {
+		log.Info(0, "aborted by shutdown signal")
+		return exitInterrupted
+	}
+	if err != nil {
+		log.Errorf(0, "pipeline error: %v", err)
+		return exitError
 	}
 
 	log.Info(0, "successfully finished")
+	return exitOK
 }
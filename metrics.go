@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	log "github.com/integration-system/isp-log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const mqpusherVersion = "dev"
+
+var (
+	rowsReadTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mqpusher_rows_read_total",
+		Help: "Total number of rows read from the source.",
+	})
+	rowsPublishedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mqpusher_rows_published_total",
+		Help: "Total number of rows successfully published.",
+	})
+	rowsFailedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqpusher_rows_failed_total",
+		Help: "Total number of rows that failed, by stage.",
+	}, []string{"stage"})
+	publishDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mqpusher_publish_duration_seconds",
+		Help:    "Duration of a single publish call.",
+		Buckets: prometheus.DefBuckets,
+	})
+	scriptDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mqpusher_script_duration_seconds",
+		Help:    "Duration of a single script conversion.",
+		Buckets: prometheus.DefBuckets,
+	})
+	sourceProgressRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mqpusher_source_progress_ratio",
+		Help: "Approximate fraction of the source consumed so far, in [0,1].",
+	})
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mqpusher_build_info",
+		Help: "Constant 1, labeled by build version.",
+	}, []string{"version"})
+	publishRetriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mqpusher_publish_retries_total",
+		Help: "Total number of publish attempts retried after a recoverable AMQP error.",
+	})
+	deadletterTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mqpusher_deadletter_total",
+		Help: "Total number of rows sent to the dead-letter sink.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		rowsReadTotal,
+		rowsPublishedTotal,
+		rowsFailedTotal,
+		publishDuration,
+		scriptDuration,
+		sourceProgressRatio,
+		buildInfo,
+		publishRetriesTotal,
+		deadletterTotal,
+	)
+	buildInfo.WithLabelValues(mqpusherVersion).Set(1)
+}
+
+// serveMetrics starts an HTTP server exposing promhttp.Handler() on
+// cfg.Addr and returns a func that shuts it down. If cfg.Addr is empty,
+// metrics are disabled and the returned func is a no-op.
+func serveMetrics(cfg MetricsConfig) func(context.Context) error {
+	if cfg.Addr == "" {
+		return func(context.Context) error { return nil }
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: cfg.Addr, Handler: mux}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf(0, "metrics server: %v", err)
+		}
+	}()
+
+	return srv.Shutdown
+}
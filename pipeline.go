@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/panjf2000/ants/v2"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+	"golang.org/x/sync/errgroup"
+)
+
+// Pipeline decouples reading rows from the DataSource, converting them
+// through the optional script and publishing them to the broker, so that
+// the slow stage (usually the publish round-trip) no longer stalls the
+// others. It is built from three stages connected by bounded channels:
+//
+//	source.GetRow -> [convert worker pool] -> [publish worker pool]
+//
+// The reader runs on a single goroutine, since DataSource.GetRow is only
+// safe to call from one goroutine at a time. The converter and publisher
+// stages each run ConverterWorkers/PublisherWorkers goroutines managed by
+// an ants.Pool.
+//
+// Every row is tagged with a sequence number as it's read; committed
+// tracks the longest contiguous prefix of those numbers that has left the
+// pipeline for good, whether published or discarded with a
+// log/dead-letter record. That, not the read count, is the only position
+// safe to persist to a checkpoint: counting a row read is premature,
+// since it may still be sitting in a queue or an in-flight worker when
+// the process dies.
+type Pipeline struct {
+	source DataSource
+	// convert, if set, builds a fresh conversion func for each converter
+	// worker goroutine. It is a factory rather than a single shared func
+	// because a *script.Executor is not safe for concurrent use: each
+	// worker needs its own.
+	convert func() func(map[string]interface{}) (map[string]interface{}, error)
+	publish func(map[string]interface{}) error
+	// onDiscard, if set, is called for every row that stage cannot
+	// deliver to the next stage - because the pipeline is shutting down
+	// or because fn itself failed - instead of dropping it silently.
+	onDiscard func(row map[string]interface{}, stage string)
+	cfg       PipelineConfig
+	committed *watermark
+}
+
+func NewPipeline(source DataSource, convert func() func(map[string]interface{}) (map[string]interface{}, error), publish func(map[string]interface{}) error, onDiscard func(row map[string]interface{}, stage string), cfg PipelineConfig) *Pipeline {
+	return &Pipeline{
+		source:    source,
+		convert:   convert,
+		publish:   publish,
+		onDiscard: onDiscard,
+		cfg:       cfg.withDefaults(),
+		committed: newWatermark(),
+	}
+}
+
+// Committed returns the longest contiguous prefix, by read order, of rows
+// that have been durably disposed of - published or discarded with a
+// log/dead-letter record. It's safe to call concurrently with Run, and is
+// what checkpointing should persist instead of the source's read count.
+func (p *Pipeline) Committed() int64 {
+	return p.committed.Low()
+}
+
+// pipelineRow carries a row alongside the sequence number it was read
+// with, so committed can advance as rows finish regardless of the order
+// the worker pools happen to finish them in.
+type pipelineRow struct {
+	seq int64
+	row map[string]interface{}
+}
+
+func isCancellation(err error) bool {
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// Run drains the source through the convert and publish stages and
+// returns the first fatal error encountered by any stage. On error, or on
+// ctx cancellation, the remaining stages stop pulling new rows but drain
+// whatever is already buffered - handing it to onDiscard rather than
+// abandoning it - before Run returns, so no row is ever lost without a
+// record of what happened to it.
+//
+// ctx is wrapped in its own cancel so that a fatal error in any single
+// worker (see stage) cancels every stage immediately, rather than only
+// after its own worker pool has drained.
+func (p *Pipeline) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	// errgroup.Wait only returns whichever goroutine happens to return
+	// first; since cancel unblocks readStage almost immediately, that's
+	// usually just context.Canceled rather than the real cause. causeOnce
+	// records the first real failure separately so Run can prefer it.
+	var (
+		causeOnce sync.Once
+		cause     error
+	)
+	fail := func(err error) {
+		causeOnce.Do(func() { cause = err })
+		cancel()
+	}
+
+	toConvert := make(chan pipelineRow, p.cfg.QueueSize)
+	toPublish := make(chan pipelineRow, p.cfg.QueueSize)
+
+	g.Go(func() error {
+		defer close(toConvert)
+		err := p.readStage(ctx, toConvert)
+		if err != nil && !isCancellation(err) {
+			fail(err)
+		}
+		return err
+	})
+
+	g.Go(func() error {
+		defer close(toPublish)
+		return p.stage(ctx, fail, p.cfg.ConverterWorkers, "convert", toConvert, toPublish, func() func(map[string]interface{}) (map[string]interface{}, error) {
+			if p.convert == nil {
+				return func(row map[string]interface{}) (map[string]interface{}, error) { return row, nil }
+			}
+			return p.convert()
+		})
+	})
+
+	g.Go(func() error {
+		return p.stage(ctx, fail, p.cfg.PublisherWorkers, "publish", toPublish, nil, func() func(map[string]interface{}) (map[string]interface{}, error) {
+			return func(row map[string]interface{}) (map[string]interface{}, error) {
+				return nil, p.publish(row)
+			}
+		})
+	})
+
+	err := g.Wait()
+	if cause != nil {
+		return cause
+	}
+	return err
+}
+
+func (p *Pipeline) readStage(ctx context.Context, out chan<- pipelineRow) error {
+	var seq int64
+	for {
+		row, err := p.source.GetRow()
+		if err != nil {
+			return errors.WithMessage(err, "read row")
+		}
+		if row == nil {
+			return nil
+		}
+
+		pr := pipelineRow{seq: seq, row: row}
+		seq++
+
+		select {
+		case out <- pr:
+		case <-ctx.Done():
+			p.discard(pr, "read")
+			return ctx.Err()
+		}
+	}
+}
+
+// discard hands row to onDiscard, if configured, instead of dropping it
+// silently, then advances committed: once a row has been logged or
+// dead-lettered it's accounted for and must not be replayed on resume,
+// even though it was never published.
+func (p *Pipeline) discard(pr pipelineRow, stage string) {
+	if p.onDiscard != nil {
+		p.onDiscard(pr.row, stage)
+	}
+	p.committed.complete(pr.seq)
+}
+
+// stage runs `workers` goroutines, managed by an ants.Pool, each pulling
+// rows from in, applying a fn of its own (built by newFn, called once per
+// worker so e.g. a non-concurrency-safe *script.Executor is never shared
+// across goroutines), and forwarding a non-nil result to out (out may be
+// nil for a terminal stage such as publishing; a nil result with no error
+// means fn intentionally filtered the row). It returns every error raised
+// by fn in any of its workers, combined with multierr.
+//
+// The first error also calls fail, which cancels ctx so siblings sharing
+// it (other stages, the reader, and this stage's own remaining workers)
+// stop pulling more rows. On ctx cancellation - from this or any other
+// stage - workers don't exit immediately: they drain in to empty first,
+// handing whatever they find to discard, so a shutdown never abandons a
+// buffered row without a record of what happened to it.
+func (p *Pipeline) stage(ctx context.Context, fail func(error), workers int, name string, in <-chan pipelineRow, out chan<- pipelineRow, newFn func() func(map[string]interface{}) (map[string]interface{}, error)) error {
+	pool, err := ants.NewPool(workers)
+	if err != nil {
+		return errors.WithMessage(err, "create worker pool")
+	}
+	defer pool.Release()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs error
+	)
+	addErr := func(err error) {
+		mu.Lock()
+		errs = multierr.Append(errs, err)
+		mu.Unlock()
+		fail(err)
+	}
+
+	drain := func() {
+		for pr := range in {
+			p.discard(pr, name)
+		}
+	}
+
+	worker := func() {
+		defer wg.Done()
+		fn := newFn()
+		for {
+			select {
+			case pr, ok := <-in:
+				if !ok {
+					return
+				}
+
+				result, err := fn(pr.row)
+				if err != nil {
+					addErr(err)
+					p.discard(pr, name)
+					drain()
+					return
+				}
+				if out == nil || result == nil {
+					p.committed.complete(pr.seq)
+					continue
+				}
+
+				select {
+				case out <- pipelineRow{seq: pr.seq, row: result}:
+				case <-ctx.Done():
+					p.discard(pipelineRow{seq: pr.seq, row: result}, name)
+					drain()
+					return
+				}
+			case <-ctx.Done():
+				drain()
+				return
+			}
+		}
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		if err := pool.Submit(worker); err != nil {
+			wg.Done()
+			addErr(errors.WithMessage(err, "submit worker"))
+			break
+		}
+	}
+
+	wg.Wait()
+
+	return errs
+}
+
+// watermark tracks completion of a sequence of positions (0, 1, 2, ...)
+// that are produced in order but, because stage's worker pools process
+// them concurrently, may complete out of order. Low reports the number of
+// leading positions that are contiguously done - the only count safe to
+// skip on resume, since a gap anywhere before it would mean an
+// undisposed row gets silently skipped.
+type watermark struct {
+	mu      sync.Mutex
+	next    int64
+	pending map[int64]struct{}
+}
+
+func newWatermark() *watermark {
+	return &watermark{pending: make(map[int64]struct{})}
+}
+
+// complete marks pos done and returns the new low-water mark.
+func (w *watermark) complete(pos int64) int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending[pos] = struct{}{}
+	for {
+		if _, ok := w.pending[w.next]; !ok {
+			break
+		}
+		delete(w.pending, w.next)
+		w.next++
+	}
+	return w.next
+}
+
+func (w *watermark) Low() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.next
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sliceDataSource is a DataSource stub that hands out n rows, each tagged
+// with its index under the "i" key, then signals EOF.
+type sliceDataSource struct {
+	n    int
+	next int64
+}
+
+func (s *sliceDataSource) GetRow() (map[string]interface{}, error) {
+	i := atomic.AddInt64(&s.next, 1) - 1
+	if i >= int64(s.n) {
+		return nil, nil
+	}
+	return map[string]interface{}{"i": i}, nil
+}
+
+func (s *sliceDataSource) Progress() (int64, float32) { return atomic.LoadInt64(&s.next), 0 }
+func (s *sliceDataSource) Total() int64               { return int64(s.n) }
+func (s *sliceDataSource) Close() error               { return nil }
+
+// discardRecorder collects rows handed to onDiscard, guarding against the
+// concurrent calls stage's worker goroutines make.
+type discardRecorder struct {
+	mu   sync.Mutex
+	rows []int64
+}
+
+func (d *discardRecorder) record(row map[string]interface{}, stage string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rows = append(d.rows, row["i"].(int64))
+}
+
+func (d *discardRecorder) indices() map[int64]bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make(map[int64]bool, len(d.rows))
+	for _, i := range d.rows {
+		out[i] = true
+	}
+	return out
+}
+
+func TestPipelineRunFatalPublishErrorDiscardsInFlightRows(t *testing.T) {
+	const total = 50
+	source := &sliceDataSource{n: total}
+	discards := &discardRecorder{}
+
+	var (
+		publishedMu sync.Mutex
+		published   = map[int64]bool{}
+	)
+	failAt := int64(5)
+	publish := func(row map[string]interface{}) error {
+		i := row["i"].(int64)
+		if i == failAt {
+			return fmt.Errorf("simulated fatal publish error for row %d", i)
+		}
+		publishedMu.Lock()
+		published[i] = true
+		publishedMu.Unlock()
+		return nil
+	}
+
+	p := NewPipeline(source, nil, publish, discards.record, PipelineConfig{
+		ConverterWorkers: 2,
+		PublisherWorkers: 2,
+		QueueSize:        1, // keep the pipeline full of backpressure so cancellation hits in-flight rows
+	})
+
+	err := p.Run(context.Background())
+	if err == nil {
+		t.Fatal("Run() error = nil, want the simulated publish error")
+	}
+
+	read := atomic.LoadInt64(&source.next)
+	if read > total {
+		read = total
+	}
+
+	discarded := discards.indices()
+	for i := int64(0); i < read; i++ {
+		publishedMu.Lock()
+		wasPublished := published[i]
+		publishedMu.Unlock()
+		if wasPublished == discarded[i] {
+			t.Fatalf("row %d: published=%v discarded=%v, want exactly one", i, wasPublished, discarded[i])
+		}
+	}
+
+	if got := p.Committed(); got != read {
+		t.Fatalf("Committed() = %d, want %d (every row read should be accounted for)", got, read)
+	}
+}
+
+func TestPipelineRunExternalCancelDrainsBufferedRows(t *testing.T) {
+	const total = 50
+	source := &sliceDataSource{n: total}
+	discards := &discardRecorder{}
+
+	blockFirst := make(chan struct{})
+	unblock := make(chan struct{})
+
+	var (
+		publishedMu sync.Mutex
+		published   = map[int64]bool{}
+	)
+	publish := func(row map[string]interface{}) error {
+		i := row["i"].(int64)
+		if i == 0 {
+			close(blockFirst)
+			<-unblock
+		}
+		publishedMu.Lock()
+		published[i] = true
+		publishedMu.Unlock()
+		return nil
+	}
+
+	p := NewPipeline(source, nil, publish, discards.record, PipelineConfig{
+		ConverterWorkers: 1,
+		PublisherWorkers: 1,
+		QueueSize:        1, // tight queues so backpressure from the stuck row 0 reaches the reader quickly
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.Run(ctx) }()
+
+	<-blockFirst
+	cancel()
+	close(unblock)
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Run() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after external cancellation")
+	}
+
+	read := atomic.LoadInt64(&source.next)
+	if read > total {
+		read = total
+	}
+
+	discarded := discards.indices()
+	for i := int64(0); i < read; i++ {
+		publishedMu.Lock()
+		wasPublished := published[i]
+		publishedMu.Unlock()
+		if wasPublished == discarded[i] {
+			t.Fatalf("row %d: published=%v discarded=%v, want exactly one", i, wasPublished, discarded[i])
+		}
+	}
+
+	if got := p.Committed(); got != read {
+		t.Fatalf("Committed() = %d, want %d (every buffered row should be published or discarded)", got, read)
+	}
+}
+
+func TestWatermarkAdvancesInOrder(t *testing.T) {
+	w := newWatermark()
+
+	if got := w.Low(); got != 0 {
+		t.Fatalf("Low() = %d, want 0", got)
+	}
+	for i := int64(0); i < 3; i++ {
+		w.complete(i)
+	}
+	if got := w.Low(); got != 3 {
+		t.Fatalf("Low() = %d, want 3", got)
+	}
+}
+
+func TestWatermarkHoldsAtGapUntilFilled(t *testing.T) {
+	w := newWatermark()
+
+	w.complete(0)
+	w.complete(2)
+	w.complete(3)
+	if got := w.Low(); got != 1 {
+		t.Fatalf("Low() = %d, want 1 (position 1 still missing)", got)
+	}
+
+	w.complete(1)
+	if got := w.Low(); got != 4 {
+		t.Fatalf("Low() = %d, want 4 (gap filled, should jump past the run)", got)
+	}
+}
+
+func TestWatermarkConcurrentOutOfOrderCompletion(t *testing.T) {
+	const n = 1000
+	w := newWatermark()
+
+	var wg sync.WaitGroup
+	// Complete in reverse order across goroutines to exercise the
+	// out-of-order path concurrently.
+	for i := int64(n - 1); i >= 0; i-- {
+		wg.Add(1)
+		go func(pos int64) {
+			defer wg.Done()
+			w.complete(pos)
+		}(i)
+	}
+	wg.Wait()
+
+	if got := w.Low(); got != n {
+		t.Fatalf("Low() = %d, want %d", got, n)
+	}
+}
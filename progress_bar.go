@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/mattn/go-isatty"
+)
+
+const progressBarInterval = time.Second
+
+// sourceTotal is implemented by DataSources that can report a known
+// upper bound for their Progress(), used as the progress bar's total.
+type sourceTotal interface {
+	Total() int64
+}
+
+// ProgressBar drives a cheggaaa/pb bar from a DataSource's Progress(),
+// showing speed, elapsed time and ETA.
+//
+// Its Current is derived from Progress()'s percentage, not its row
+// count, because Total() (the bar's denominator) is not always in rows:
+// CsvDataSource reports a byte size, while DbDataSource reports a row
+// count. The percentage is always already scaled against Total(),
+// whatever unit it's in, so total*percent/100 keeps Current and Total
+// consistent for every DataSource.
+type ProgressBar struct {
+	bar   *pb.ProgressBar
+	total int64
+}
+
+// NewProgressBar returns nil, meaning no bar is shown, unless enabled is
+// true and stdout is a terminal.
+func NewProgressBar(enabled bool, source DataSource) *ProgressBar {
+	if !enabled || !isatty.IsTerminal(os.Stdout.Fd()) {
+		return nil
+	}
+
+	var total int64
+	if t, ok := source.(sourceTotal); ok {
+		total = t.Total()
+	}
+
+	bar := pb.New64(total)
+	bar.SetTemplateString(`{{string . "prefix"}}{{counters . }} {{bar . }} {{percent . }} {{speed . }} {{etime . }} {{rtime . "ETA %s"}}`)
+	bar.Start()
+
+	return &ProgressBar{bar: bar, total: total}
+}
+
+// Watch polls source.Progress() until ctx is cancelled, updating the
+// bar's current position.
+func (p *ProgressBar) Watch(ctx context.Context, source DataSource) {
+	if p == nil {
+		return
+	}
+
+	ticker := time.NewTicker(progressBarInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_, percent := source.Progress()
+			p.bar.SetCurrent(int64(float32(p.total) * percent / 100))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Finish stops the bar, leaving its final state printed above the
+// prompt.
+func (p *ProgressBar) Finish() {
+	if p == nil {
+		return
+	}
+	p.bar.Finish()
+}
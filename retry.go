@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// isRecoverablePublishErr reports whether err likely reflects a transient
+// broker/connection hiccup worth retrying, as opposed to a permanent
+// rejection (e.g. a malformed message or missing exchange).
+func isRecoverablePublishErr(err error) bool {
+	if errors.Is(err, amqp.ErrClosed) {
+		return true
+	}
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) {
+		return amqpErr.Recover
+	}
+	return false
+}
+
+// backoff computes the delay before retry attempt (1-based), growing
+// geometrically from cfg.InitialBackoff by cfg.Multiplier, capped at
+// cfg.MaxBackoff, and jittered by up to cfg.Jitter of that value.
+func backoff(cfg RetryConfig, attempt int) time.Duration {
+	d := float64(cfg.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		d *= cfg.Multiplier
+		if d > float64(cfg.MaxBackoff) {
+			d = float64(cfg.MaxBackoff)
+			break
+		}
+	}
+	if d > float64(cfg.MaxBackoff) {
+		d = float64(cfg.MaxBackoff)
+	}
+
+	jitter := d * cfg.Jitter * (rand.Float64()*2 - 1)
+	d += jitter
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
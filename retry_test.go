@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffGrowsGeometricallyAndCaps(t *testing.T) {
+	cfg := RetryConfig{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     1 * time.Second,
+		Multiplier:     2,
+		Jitter:         0, // isolate the growth/cap math from jitter
+	}
+
+	want := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		1 * time.Second, // would be 1.6s uncapped
+		1 * time.Second,
+	}
+	for attempt, w := range want {
+		if got := backoff(cfg, attempt+1); got != w {
+			t.Errorf("attempt %d: backoff = %v, want %v", attempt+1, got, w)
+		}
+	}
+}
+
+func TestBackoffJitterStaysWithinBounds(t *testing.T) {
+	cfg := RetryConfig{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     1 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		base := float64(100*time.Millisecond) * pow(2, attempt-1)
+		if base > float64(cfg.MaxBackoff) {
+			base = float64(cfg.MaxBackoff)
+		}
+		lo := time.Duration(base * 0.8)
+		hi := time.Duration(base * 1.2)
+
+		for i := 0; i < 50; i++ {
+			d := backoff(cfg, attempt)
+			if d < 0 {
+				t.Fatalf("attempt %d: backoff = %v, want >= 0", attempt, d)
+			}
+			if d < lo || d > hi {
+				t.Fatalf("attempt %d: backoff = %v, want in [%v, %v]", attempt, d, lo, hi)
+			}
+		}
+	}
+}
+
+func pow(base float64, exp int) float64 {
+	r := 1.0
+	for i := 0; i < exp; i++ {
+		r *= base
+	}
+	return r
+}
@@ -0,0 +1,63 @@
+// Package script runs user-provided JavaScript row conversion scripts
+// against the rows read from a DataSource.
+package script
+
+import (
+	"github.com/dop251/goja"
+	"github.com/pkg/errors"
+)
+
+const entryPoint = "convert"
+
+// Script is a parsed, ready to run conversion script. A script must
+// declare a top-level `function convert(row) { ... }` that returns the
+// converted row.
+type Script struct {
+	program *goja.Program
+}
+
+// Create compiles the given script source.
+func Create(src []byte) (*Script, error) {
+	program, err := goja.Compile("script.js", string(src), true)
+	if err != nil {
+		return nil, errors.WithMessage(err, "compile script")
+	}
+	return &Script{program: program}, nil
+}
+
+// Executor runs Scripts. It is not safe for concurrent use; callers that
+// run scripts from multiple goroutines should use one Executor per
+// goroutine via New.
+type Executor struct {
+	vm *goja.Runtime
+}
+
+func New() *Executor {
+	return &Executor{vm: goja.New()}
+}
+
+var defaultExecutor = New()
+
+// Default returns a package-level Executor for single-goroutine callers.
+func Default() *Executor {
+	return defaultExecutor
+}
+
+// Execute runs the script against row and returns the converted value.
+func (e *Executor) Execute(s *Script, row map[string]interface{}) (interface{}, error) {
+	if _, err := e.vm.RunProgram(s.program); err != nil {
+		return nil, errors.WithMessage(err, "run script")
+	}
+
+	convert, ok := goja.AssertFunction(e.vm.Get(entryPoint))
+	if !ok {
+		return nil, errors.Errorf("script does not declare a %q function", entryPoint)
+	}
+
+	result, err := convert(goja.Undefined(), e.vm.ToValue(row))
+	if err != nil {
+		return nil, errors.WithMessage(err, "execute convert")
+	}
+
+	return result.Export(), nil
+}